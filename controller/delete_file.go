@@ -0,0 +1,94 @@
+package controller
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// deleteByDeleteKey removes a file purely on the strength of its delete_key,
+// without requiring a Hasura JWT, so anonymous uploaders can revoke their
+// own uploads.
+func (ctrl *Controller) deleteByDeleteKey(ctx context.Context, fileID, deleteKey string) *APIError {
+	metadata, apiErr := ctrl.metadataStorage.GetFileByID(ctx, fileID, ctrl.adminHeaders())
+	if apiErr != nil {
+		return apiErr
+	}
+
+	if !deleteKeysMatch(deleteKey, metadata.DeleteKey) {
+		return ErrForbidden
+	}
+
+	return ctrl.deleteFileByID(ctx, fileID)
+}
+
+// deleteKeysMatch reports whether provided is the delete_key on file,
+// comparing in constant time since this is the sole credential guarding an
+// anonymous delete. Either side being empty is always a mismatch, so a file
+// with no delete_key (uploaded without one) can never be deleted this way.
+func deleteKeysMatch(provided, actual string) bool {
+	if provided == "" || actual == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(provided), []byte(actual)) == 1
+}
+
+// deleteFileByID removes the blob and its metadata row for fileID, the same
+// path used by the rest of the delete flow, so hash-deduped files keep going
+// through the reference counting in DeleteFileByID.
+func (ctrl *Controller) deleteFileByID(ctx context.Context, fileID string) *APIError {
+	return ctrl.metadataStorage.DeleteFileByID(ctx, fileID, ctrl.adminHeaders())
+}
+
+// DeleteFileByDeleteKey handles DELETE /files/:id?delete_key=... for
+// anonymous uploaders revoking their own upload.
+func (ctrl *Controller) DeleteFileByDeleteKey(ctx *gin.Context) {
+	fileID := ctx.Param("id")
+	deleteKey := ctx.Query("delete_key")
+
+	if apiErr := ctrl.deleteByDeleteKey(ctx.Request.Context(), fileID, deleteKey); apiErr != nil {
+		_ = ctx.Error(fmt.Errorf("problem processing request: %w", apiErr))
+		ctx.JSON(apiErr.statusCode, UploadFileResponse{nil, apiErr.PublicResponse()})
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
+
+// RunExpirySweeper periodically scans metadata for files whose expires_at
+// has passed and deletes them through the same path DeleteFileByDeleteKey
+// uses, so expiry doesn't need its own cleanup logic in the storage backend.
+// It blocks until ctx is cancelled and is meant to be started in its own
+// goroutine from main.
+func (ctrl *Controller) RunExpirySweeper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ctrl.sweepExpiredFiles(ctx)
+		}
+	}
+}
+
+func (ctrl *Controller) sweepExpiredFiles(ctx context.Context) {
+	expired, apiErr := ctrl.metadataStorage.ListExpiredFiles(ctx, time.Now(), ctrl.adminHeaders())
+	if apiErr != nil {
+		ctrl.logger.Error("problem listing expired files", "error", apiErr)
+		return
+	}
+
+	for _, metadata := range expired {
+		if apiErr := ctrl.deleteFileByID(ctx, metadata.ID); apiErr != nil {
+			ctrl.logger.Error("problem deleting expired file", "file_id", metadata.ID, "error", apiErr)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package controller
+
+import "testing"
+
+func TestDeleteKeysMatch(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]struct {
+		provided string
+		actual   string
+		want     bool
+	}{
+		"matching keys":     {provided: "abc123", actual: "abc123", want: true},
+		"mismatched keys":   {provided: "abc123", actual: "def456", want: false},
+		"different lengths": {provided: "abc", actual: "abc123", want: false},
+		"provided empty":    {provided: "", actual: "abc123", want: false},
+		"actual empty":      {provided: "abc123", actual: "", want: false},
+		"both empty":        {provided: "", actual: "", want: false},
+	}
+
+	for name, tc := range cases {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			if got := deleteKeysMatch(tc.provided, tc.actual); got != tc.want {
+				t.Errorf("deleteKeysMatch(%q, %q) = %v, want %v", tc.provided, tc.actual, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// PresignedPostRequest describes what the client wants to upload, so the
+// policy we hand back can be scoped as tightly as the bucket allows. ID is
+// optional; if empty the server generates one and it becomes both the
+// object key and, later, the file's metadata ID.
+type PresignedPostRequest struct {
+	BucketID          string `json:"bucket-id"`
+	ContentTypePrefix string `json:"content_type_prefix"`
+	ID                string `json:"id"`
+}
+
+// PresignedPostResponse is everything a browser needs to POST a file
+// straight to the S3-compatible backend: the target URL, the form fields to
+// send alongside the file (including the signature), and the key the object
+// will end up at, which the client must echo back to FinalizeFile. ID and
+// Key are always equal - FinalizeFile uses the key as the file's metadata ID
+// so the object it heads is the same one the row ends up pointing at.
+type PresignedPostResponse struct {
+	URL       string            `json:"url"`
+	Fields    map[string]string `json:"fields"`
+	Key       string            `json:"key"`
+	ID        string            `json:"id"`
+	ExpiresAt time.Time         `json:"expiresAt"`
+}
+
+// PresignedPost returns a short-lived POST policy so the browser can upload
+// directly to contentStorage without proxying bytes through this process.
+func (ctrl *Controller) PresignedPost(ctx *gin.Context) {
+	var req PresignedPostRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		apiErr := WrongMetadataFormatError(err)
+		_ = ctx.Error(fmt.Errorf("problem processing request: %w", apiErr))
+		ctx.JSON(apiErr.statusCode, UploadFileResponse{nil, apiErr.PublicResponse()})
+		return
+	}
+
+	bucket, apiErr := ctrl.getBucket(ctx.Request.Context(), req.BucketID)
+	if apiErr != nil {
+		_ = ctx.Error(fmt.Errorf("problem processing request: %w", apiErr))
+		ctx.JSON(apiErr.statusCode, UploadFileResponse{nil, apiErr.PublicResponse()})
+		return
+	}
+
+	fileID := req.ID
+	if fileID == "" {
+		fileID = uuid.New().String()
+	}
+
+	// Keyed by the file's own ID, matching every other path in this package
+	// (uploadOne's PutFile, variantKey) so FinalizeFile can key the object
+	// and the metadata row identically.
+	key := fileID
+
+	policy, apiErr := ctrl.contentStorage.CreatePresignedPostPolicy(
+		key, req.ContentTypePrefix, bucket.MinUploadFile, bucket.MaxUploadFile, presignedPostExpiry,
+	)
+	if apiErr != nil {
+		_ = ctx.Error(fmt.Errorf("problem processing request: %w", apiErr))
+		ctx.JSON(apiErr.statusCode, UploadFileResponse{nil, apiErr.PublicResponse()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, PresignedPostResponse{
+		URL:       policy.URL,
+		Fields:    policy.Fields,
+		Key:       key,
+		ID:        fileID,
+		ExpiresAt: policy.ExpiresAt,
+	})
+}
+
+// presignedPostExpiry bounds how long a browser has to complete a direct
+// upload before the signature stops working.
+const presignedPostExpiry = 15 * time.Minute
+
+// FinalizeFileRequest is what the client sends once it has finished
+// POSTing bytes directly to contentStorage via a presigned policy. Key is
+// the value PresignedPostResponse.Key/ID returned - it doubles as the
+// file's metadata ID, since PresignedPost keys the object by that same ID.
+type FinalizeFileRequest struct {
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	BucketID string `json:"bucket-id"`
+}
+
+// FinalizeFile runs the metadata-population half of the upload flow for a
+// file whose bytes are already sitting in contentStorage: it reads size,
+// etag and content-type back from the object via HeadFile rather than
+// trusting the client, then calls the same populateFileMetadata used by the
+// classic multipart path. The metadata row's ID is req.Key itself, not a
+// client-supplied ID, so it always matches the object PresignedPost actually
+// wrote to.
+func (ctrl *Controller) FinalizeFile(ctx *gin.Context) {
+	var req FinalizeFileRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		apiErr := WrongMetadataFormatError(err)
+		_ = ctx.Error(fmt.Errorf("problem processing request: %w", apiErr))
+		ctx.JSON(apiErr.statusCode, UploadFileResponse{nil, apiErr.PublicResponse()})
+		return
+	}
+
+	bucket, apiErr := ctrl.getBucket(ctx.Request.Context(), req.BucketID)
+	if apiErr != nil {
+		_ = ctx.Error(fmt.Errorf("problem processing request: %w", apiErr))
+		ctx.JSON(apiErr.statusCode, UploadFileResponse{nil, apiErr.PublicResponse()})
+		return
+	}
+
+	head, apiErr := ctrl.contentStorage.HeadFile(req.Key)
+	if apiErr != nil {
+		_ = ctx.Error(fmt.Errorf("problem processing request: %w", apiErr))
+		ctx.JSON(apiErr.statusCode, UploadFileResponse{nil, apiErr.PublicResponse()})
+		return
+	}
+
+	file := fileData{Name: req.Name, ID: req.Key}
+
+	apiErr = ctrl.metadataStorage.InitializeFile(
+		ctx.Request.Context(),
+		file.ID, file.Name, 0, bucket.ID, head.ContentType, time.Time{}, "",
+		ctx.Request.Header,
+	)
+	if apiErr != nil {
+		_ = ctx.Error(fmt.Errorf("problem processing request: %w", apiErr))
+		ctx.JSON(apiErr.statusCode, UploadFileResponse{nil, apiErr.PublicResponse()})
+		return
+	}
+
+	metadata, apiErr := ctrl.populateFileMetadata(
+		ctx.Request.Context(), file, bucket, head.Size, head.ETag, head.ContentType, "", "", "",
+	)
+	if apiErr != nil {
+		_ = ctx.Error(fmt.Errorf("problem processing request: %w", apiErr))
+		ctx.JSON(apiErr.statusCode, UploadFileResponse{[]FileMetadata{}, apiErr.PublicResponse()})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, UploadFileResponse{[]FileMetadata{metadata}, nil})
+}
@@ -3,18 +3,25 @@ package controller
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
 	_ "image/jpeg"
-	_ "image/png"
+	"image/png"
+	"io"
 	"mime/multipart"
 	"net/http"
+	"os"
+	"strconv"
+	"time"
 
 	_ "golang.org/x/image/webp"
 
 	"github.com/buckket/go-blurhash"
+	"github.com/disintegration/imaging"
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
@@ -27,260 +34,564 @@ type UploadFileResponse struct {
 }
 
 type fileData struct {
-	Name   string `json:"name"`
-	ID     string `json:"id"`
-	header *multipart.FileHeader
+	Name string `json:"name"`
+	ID   string `json:"id"`
+	// ExpiresAt is optional: RFC3339 timestamp or seconds-from-now, parsed by
+	// parseExpiresAt. An empty string means the file never expires.
+	ExpiresAt string `json:"expires_at"`
+	// DeleteKey is optional; if empty the server generates one and returns
+	// it in the upload response so anonymous uploaders can later delete the
+	// file via DeleteFileByDeleteKey without a Hasura JWT.
+	DeleteKey string `json:"delete_key"`
 }
 
-type uploadFileRequest struct {
-	bucketID string
-	files    []fileData
-	headers  http.Header
+// FileVariant describes one pre-rendered thumbnail stored alongside a
+// FileMetadata's original object, so GET /files/:id?variant=<name> can serve
+// it directly instead of transforming the image per request.
+type FileVariant struct {
+	Name        string `json:"name"`
+	Size        int64  `json:"size"`
+	ETag        string `json:"etag"`
+	ContentType string `json:"contentType"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
 }
 
-func checkFileSize(file *multipart.FileHeader, minSize, maxSize int) *APIError {
-	if minSize > int(file.Size) {
-		return FileTooSmallError(file.Filename, int(file.Size), minSize)
-	} else if int(file.Size) > maxSize {
-		return FileTooBigError(file.Filename, int(file.Size), maxSize)
+// parseExpiresAt accepts either an RFC3339 timestamp or a number of seconds
+// from now. An empty string means the file never expires and is reported as
+// a zero time.Time.
+func parseExpiresAt(s string) (time.Time, *APIError) {
+	if s == "" {
+		return time.Time{}, nil
 	}
 
-	return nil
-}
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Now().Add(time.Duration(secs) * time.Second), nil
+	}
 
-func (ctrl *Controller) getMultipartFile(file fileData) (multipart.File, string, *APIError) {
-	fileContent, err := file.header.Open()
+	t, err := time.Parse(time.RFC3339, s)
 	if err != nil {
-		return nil, "", InternalServerError(fmt.Errorf("problem opening file %s: %w", file.Name, err))
+		return time.Time{}, WrongMetadataFormatError(fmt.Errorf("invalid expires_at %q: %w", s, err))
 	}
 
-	contentType := file.header.Header.Get("Content-Type")
-	if contentType != "" && contentType != "application/octet-stream" {
-		return fileContent, contentType, nil
+	return t, nil
+}
+
+// sniffPartContentType reads at most 512 bytes from r to detect its MIME
+// type and returns a reader that replays those bytes followed by the rest
+// of r, so nothing read during detection is lost from the stream.
+func sniffPartContentType(r io.Reader) (io.Reader, string, *APIError) {
+	buf := make([]byte, 512)
+
+	n, err := io.ReadFull(r, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, "", readErr(err, "problem sniffing content type")
 	}
+	buf = buf[:n]
 
-	mt, err := mimetype.DetectReader(fileContent)
-	if err != nil {
-		return nil, "",
-			InternalServerError(fmt.Errorf("problem figuring out content type for file %s: %w", file.Name, err))
+	mt := mimetype.Detect(buf)
+
+	return io.MultiReader(bytes.NewReader(buf), r), mt.String(), nil
+}
+
+// readErr recovers the *APIError a wrapped reader (e.g. maxSizeReader)
+// already produced - such as FileTooBigError mid-stream - instead of
+// masking it behind a generic InternalServerError.
+func readErr(err error, msg string) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
 	}
 
-	file.header.Header.Add("Content-Type", mt.String())
-	fileContent, err = file.header.Open()
-	if err != nil {
-		return nil, "", InternalServerError(fmt.Errorf("problem opening file %s: %w", file.Name, err))
+	return InternalServerError(fmt.Errorf("%s: %w", msg, err))
+}
+
+// maxSizeReader wraps a multipart part and fails with FileTooBigError as
+// soon as more than maxSize bytes have been read off it, instead of
+// buffering the whole part first to learn its size.
+type maxSizeReader struct {
+	r       io.Reader
+	name    string
+	maxSize int
+	read    int
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.read += n
+	if m.read > m.maxSize {
+		return n, FileTooBigError(m.name, m.read, m.maxSize)
 	}
-	return fileContent, mt.String(), nil
+	return n, err
 }
 
-func (ctrl *Controller) upload(
+// uploadOne streams a single file's content through the mime sniffer and,
+// for images, the webp re-encoder, and hands the result to contentStorage
+// as a stream. Images are the exception: their original bytes are held in
+// memory in full for decoding and as the webp encoder's input; only the
+// encoder's output is streamed.
+func (ctrl *Controller) uploadOne(
 	ctx context.Context,
-	request uploadFileRequest,
-) ([]FileMetadata, *APIError) {
-	bucket, err := ctrl.metadataStorage.GetBucketByID(
-		ctx,
-		request.bucketID,
-		http.Header{"x-hasura-admin-secret": []string{ctrl.hasuraAdminSecret}},
-	)
-	if err != nil {
-		return nil, err
+	bucket Bucket,
+	file fileData,
+	partReader io.Reader,
+	headers http.Header,
+) (FileMetadata, *APIError) {
+	expiresAt, apiErr := parseExpiresAt(file.ExpiresAt)
+	if apiErr != nil {
+		return FileMetadata{}, apiErr
+	}
+
+	deleteKey := file.DeleteKey
+	if deleteKey == "" {
+		deleteKey = uuid.New().String()
 	}
 
-	filesMetadata := make([]FileMetadata, 0, len(request.files))
+	limited := &maxSizeReader{r: partReader, name: file.Name, maxSize: bucket.MaxUploadFile}
+
+	sniffed, contentType, apiErr := sniffPartContentType(limited)
+	if apiErr != nil {
+		return FileMetadata{}, apiErr
+	}
 
-	for _, file := range request.files {
-		if err := checkFileSize(file.header, bucket.MinUploadFile, bucket.MaxUploadFile); err != nil {
-			return filesMetadata, InternalServerError(fmt.Errorf("problem checking file size %s: %w", file.Name, err))
+	var reader io.Reader = sniffed
+	hash := ""
+	var decodedImg image.Image
+
+	switch contentType {
+	case "image/webp", "image/png", "image/jpeg":
+		// Images are small relative to bucket.MaxUploadFile, so buffering the
+		// original bytes here is fine; it's the webp re-encode below that we
+		// stream, since that's the part that used to double the peak memory.
+		original := &bytes.Buffer{}
+		if _, err := io.Copy(original, sniffed); err != nil {
+			return FileMetadata{}, readErr(err, fmt.Sprintf("problem reading file %s", file.Name))
 		}
 
-		fileContent, contentType, err := ctrl.getMultipartFile(file)
+		img, _, e := image.Decode(bytes.NewReader(original.Bytes()))
+		if e != nil {
+			return FileMetadata{}, InternalServerError(fmt.Errorf("problem converting to image.Image %s: %w", file.Name, e))
+		}
+		decodedImg = img
+
+		// Blurhash and the thumbnail variants below are both computed once
+		// from this decode, instead of re-decoding per variant.
+		hash, e = blurhash.Encode(4, 3, img)
+		if e != nil {
+			return FileMetadata{}, InternalServerError(fmt.Errorf("problem generating Blurhash for file %s: %w", file.Name, e))
+		}
+
+		pr, pw := io.Pipe()
+		go func() {
+			encodeErr := ctrl.imageTransformer.SaveAsWebp(bytes.NewReader(original.Bytes()), uint64(original.Len()), pw)
+			_ = pw.CloseWithError(encodeErr)
+		}()
+
+		reader = pr
+		contentType = "image/webp"
+	}
+
+	apiErr = ctrl.metadataStorage.InitializeFile(
+		ctx,
+		file.ID, file.Name, 0, bucket.ID, contentType, expiresAt, deleteKey,
+		headers)
+	if apiErr != nil {
+		return FileMetadata{}, apiErr
+	}
+
+	var (
+		etag        string
+		size        int64
+		contentHash string
+	)
+
+	if bucket.DedupeByHash {
+		// Deduping needs the digest before we decide whether to touch
+		// storage at all, so there's no way to avoid a full read here the
+		// way the TeeReader below does for the common case. The bytes are
+		// spooled to a temp file rather than a bytes.Buffer so this doesn't
+		// reintroduce the whole-upload-in-memory problem for dedupe-enabled
+		// buckets.
+		spool, err := os.CreateTemp("", "hasura-storage-upload-*")
 		if err != nil {
-			return filesMetadata, err
+			return FileMetadata{}, InternalServerError(fmt.Errorf("problem creating temp file for %s: %w", file.Name, err))
 		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
 
-		defer fileContent.Close()
+		hasher := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(spool, hasher), reader); err != nil {
+			return FileMetadata{}, readErr(err, fmt.Sprintf("problem reading file %s", file.Name))
+		}
+		contentHash = hex.EncodeToString(hasher.Sum(nil))
 
-		fileSize := file.header.Size
-		hash := ""
-		switch contentType {
-		case "image/webp", "image/png", "image/jpeg":
-			buf := &bytes.Buffer{}
-			ctrl.imageTransformer.SaveAsWebp(fileContent, uint64(file.header.Size), buf)
-			fileContent = NewP(buf.Bytes())
+		existing, found, apiErr := ctrl.metadataStorage.GetFileByHash(
+			ctx, bucket.ID, contentHash, ctrl.adminHeaders(),
+		)
+		if apiErr != nil {
+			return FileMetadata{}, apiErr
+		}
+
+		if found {
+			// The blob is shared with the file we deduped against, so there's
+			// nothing to generate, but its thumbnail variants still need to
+			// be copied onto our own file ID: variantKey scopes each
+			// thumbnail object to its owning file, and the existing file's
+			// variants live under existing.ID, not file.ID.
+			variants, apiErr := ctrl.copyVariants(existing.ID, file.ID, existing.Variants)
+			if apiErr != nil {
+				_ = ctrl.metadataStorage.DeleteFileByID(ctx, file.ID, ctrl.adminHeaders())
+				return FileMetadata{}, apiErr.ExtendError("problem copying thumbnail variants for deduped file")
+			}
 
-			img, _, e := image.Decode(fileContent)
-			if e != nil {
-				return filesMetadata, InternalServerError(fmt.Errorf("problem converting to image.Image %s: %w", file.Name, e))
+			metadata, apiErr := ctrl.populateFileMetadata(ctx, file, bucket, existing.Size, existing.ETag, contentType, hash, contentHash, deleteKey)
+			if apiErr != nil {
+				ctrl.rollbackVariants(variantKeys(file.ID, variants))
+				_ = ctrl.metadataStorage.DeleteFileByID(ctx, file.ID, ctrl.adminHeaders())
+				return FileMetadata{}, apiErr
 			}
-			fileSize = int64(buf.Len())
 
-			hash, e = blurhash.Encode(4, 3, img)
-			if e != nil {
-				return filesMetadata, InternalServerError(fmt.Errorf("problem generating Blurhash for file %s: %w", file.Name, e))
+			if len(variants) > 0 {
+				metadata, apiErr = ctrl.metadataStorage.SetFileVariants(ctx, file.ID, variants, ctrl.adminHeaders())
+				if apiErr != nil {
+					ctrl.rollbackVariants(variantKeys(file.ID, variants))
+					_ = ctrl.metadataStorage.DeleteFileByID(ctx, file.ID, ctrl.adminHeaders())
+					return FileMetadata{}, apiErr
+				}
 			}
-			contentType = "image/webp"
+
+			return metadata, nil
 		}
 
-		apiErr := ctrl.metadataStorage.InitializeFile(
-			ctx,
-			file.ID, file.Name, fileSize, bucket.ID, contentType,
-			request.headers)
-		if apiErr != nil {
-			return filesMetadata, apiErr
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return FileMetadata{}, InternalServerError(fmt.Errorf("problem rewinding spooled file %s: %w", file.Name, err))
 		}
 
-		etag, apiErr := ctrl.contentStorage.PutFile(fileContent, file.ID, contentType)
-		if apiErr != nil {
-			_ = ctrl.metadataStorage.DeleteFileByID(
-				ctx,
-				file.ID,
-				http.Header{"x-hasura-admin-secret": []string{ctrl.hasuraAdminSecret}},
-			)
-			return filesMetadata, apiErr.ExtendError("problem uploading file to storage")
+		etag, size, apiErr = ctrl.contentStorage.PutFile(spool, file.ID, contentType)
+	} else {
+		hasher := sha256.New()
+		etag, size, apiErr = ctrl.contentStorage.PutFile(io.TeeReader(reader, hasher), file.ID, contentType)
+		contentHash = hex.EncodeToString(hasher.Sum(nil))
+		if etag == "" {
+			etag = contentHash
 		}
+	}
 
-		metadata, apiErr := ctrl.metadataStorage.PopulateMetadata(
-			ctx,
-			file.ID, file.Name, fileSize, bucket.ID, etag, true, contentType, hash,
-			http.Header{"x-hasura-admin-secret": []string{ctrl.hasuraAdminSecret}},
-		)
+	if apiErr != nil {
+		_ = ctrl.metadataStorage.DeleteFileByID(ctx, file.ID, ctrl.adminHeaders())
+		return FileMetadata{}, apiErr.ExtendError("problem uploading file to storage")
+	}
+
+	if int(size) < bucket.MinUploadFile {
+		_ = ctrl.contentStorage.DeleteFile(file.ID)
+		_ = ctrl.metadataStorage.DeleteFileByID(ctx, file.ID, ctrl.adminHeaders())
+		return FileMetadata{}, FileTooSmallError(file.Name, int(size), bucket.MinUploadFile)
+	}
+
+	metadata, apiErr := ctrl.populateFileMetadata(ctx, file, bucket, size, etag, contentType, hash, contentHash, deleteKey)
+	if apiErr != nil {
+		return FileMetadata{}, apiErr
+	}
+
+	if decodedImg != nil && len(bucket.ThumbnailSizes) > 0 {
+		variants, apiErr := ctrl.generateVariants(ctx, bucket, file.ID, decodedImg)
 		if apiErr != nil {
-			return filesMetadata, apiErr.ExtendError(fmt.Sprintf("problem populating file metadata for file %s", file.Name))
+			_ = ctrl.contentStorage.DeleteFile(file.ID)
+			_ = ctrl.metadataStorage.DeleteFileByID(ctx, file.ID, ctrl.adminHeaders())
+			return FileMetadata{}, apiErr.ExtendError(fmt.Sprintf("problem generating thumbnail variants for file %s", file.Name))
 		}
 
-		filesMetadata = append(filesMetadata, metadata)
+		metadata, apiErr = ctrl.metadataStorage.SetFileVariants(ctx, file.ID, variants, ctrl.adminHeaders())
+		if apiErr != nil {
+			ctrl.rollbackVariants(variantKeys(file.ID, variants))
+			_ = ctrl.contentStorage.DeleteFile(file.ID)
+			_ = ctrl.metadataStorage.DeleteFileByID(ctx, file.ID, ctrl.adminHeaders())
+			return FileMetadata{}, apiErr.ExtendError(fmt.Sprintf("problem saving thumbnail variants for file %s", file.Name))
+		}
 	}
 
-	return filesMetadata, nil
+	return metadata, nil
+}
+
+// variantKey is the object key a thumbnail variant is stored under,
+// alongside the original file.
+func variantKey(fileID, name string) string {
+	return fmt.Sprintf("%s/%s.webp", fileID, name)
 }
 
-func fileDataFromFormValue(md map[string][]string, fileHedaer *multipart.FileHeader, i int) (fileData, *APIError) {
-	formValue := []byte("{}")
-	userSpecified, ok := md["metadata[]"]
-	if ok {
-		formValue = []byte(userSpecified[i])
+// variantKeys maps a set of already-written FileVariants back to the object
+// keys they were stored under, so a later failure can roll them all back via
+// rollbackVariants.
+func variantKeys(fileID string, variants []FileVariant) []string {
+	keys := make([]string, 0, len(variants))
+	for _, v := range variants {
+		keys = append(keys, variantKey(fileID, v.Name))
 	}
 
-	data := fileData{}
+	return keys
+}
+
+// generateVariants renders each of bucket.ThumbnailSizes from img with a
+// Lanczos resizer, webp-encodes them, and stores each under variantKey. If
+// writing variant N fails, the variants already written (0..N-1) are deleted
+// so an image never ends up with a partial set, matching the all-or-nothing
+// semantics of the rest of upload().
+func (ctrl *Controller) generateVariants(
+	ctx context.Context, bucket Bucket, fileID string, img image.Image,
+) ([]FileVariant, *APIError) {
+	variants := make([]FileVariant, 0, len(bucket.ThumbnailSizes))
+	keys := make([]string, 0, len(bucket.ThumbnailSizes))
+
+	for _, spec := range bucket.ThumbnailSizes {
+		var thumb image.Image
+		switch spec.Fit {
+		case "cover":
+			thumb = imaging.Fill(img, spec.Width, spec.Height, imaging.Center, imaging.Lanczos)
+		default: // "contain"
+			// Fit only when both dimensions are positive: Fit returns an
+			// empty 0x0 image otherwise, so a spec like {w:800,h:0} - "800
+			// wide, preserve aspect ratio" - goes to Resize, which treats a 0
+			// dimension as "preserve aspect ratio on that axis" instead.
+			if spec.Width > 0 && spec.Height > 0 {
+				thumb = imaging.Fit(img, spec.Width, spec.Height, imaging.Lanczos)
+			} else {
+				thumb = imaging.Resize(img, spec.Width, spec.Height, imaging.Lanczos)
+			}
+		}
+
+		decoded := &bytes.Buffer{}
+		if err := png.Encode(decoded, thumb); err != nil {
+			ctrl.rollbackVariants(keys)
+			return nil, InternalServerError(fmt.Errorf("problem encoding thumbnail: %w", err))
+		}
+
+		encoded := &bytes.Buffer{}
+		if err := ctrl.imageTransformer.SaveAsWebp(bytes.NewReader(decoded.Bytes()), uint64(decoded.Len()), encoded); err != nil {
+			ctrl.rollbackVariants(keys)
+			return nil, InternalServerError(fmt.Errorf("problem encoding thumbnail as webp: %w", err))
+		}
 
-	if err := json.Unmarshal(formValue, &data); err != nil {
-		return fileData{}, WrongMetadataFormatError(err)
+		name := fmt.Sprintf("thumb_%dx%d", spec.Width, spec.Height)
+		key := variantKey(fileID, name)
+
+		etag, size, apiErr := ctrl.contentStorage.PutFile(bytes.NewReader(encoded.Bytes()), key, "image/webp")
+		if apiErr != nil {
+			ctrl.rollbackVariants(keys)
+			return nil, apiErr.ExtendError("problem uploading thumbnail variant to storage")
+		}
+		keys = append(keys, key)
+
+		bounds := thumb.Bounds()
+		variants = append(variants, FileVariant{
+			Name:        name,
+			Size:        size,
+			ETag:        etag,
+			ContentType: "image/webp",
+			Width:       bounds.Dx(),
+			Height:      bounds.Dy(),
+		})
 	}
-	data.header = fileHedaer
 
-	return data, nil
+	return variants, nil
 }
 
-func getBucketIDFromFormValue(md map[string][]string) string {
-	bucketID, ok := md["bucket-id"]
-	if ok {
-		return bucketID[0]
+// rollbackVariants deletes thumbnail objects already written for a file
+// whose variant generation failed partway through.
+func (ctrl *Controller) rollbackVariants(keys []string) {
+	for _, key := range keys {
+		_ = ctrl.contentStorage.DeleteFile(key)
 	}
-	return "default"
 }
 
-func parseUploadRequestOld(ctx *gin.Context) (uploadFileRequest, *APIError) {
-	form, err := ctx.MultipartForm()
-	if err != nil {
-		return uploadFileRequest{}, InternalServerError(fmt.Errorf("problem reading multipart form: %w", err))
-	}
+// copyVariants duplicates each of srcFileID's thumbnail objects under
+// dstFileID's own variant keys, so a file that dedupes onto srcFileID's blob
+// still resolves GET ?variant=... requests against its own file ID instead
+// of a key nothing was ever written to.
+func (ctrl *Controller) copyVariants(srcFileID, dstFileID string, variants []FileVariant) ([]FileVariant, *APIError) {
+	copied := make([]FileVariant, 0, len(variants))
+	keys := make([]string, 0, len(variants))
+
+	for _, v := range variants {
+		content, apiErr := ctrl.contentStorage.GetFile(variantKey(srcFileID, v.Name))
+		if apiErr != nil {
+			ctrl.rollbackVariants(keys)
+			return nil, apiErr
+		}
 
-	fileForm, ok := form.File["file"]
-	if !ok {
-		return uploadFileRequest{}, ErrMultipartFormFileNotFound
+		key := variantKey(dstFileID, v.Name)
+		etag, size, apiErr := ctrl.contentStorage.PutFile(content, key, v.ContentType)
+		_ = content.Close()
+		if apiErr != nil {
+			ctrl.rollbackVariants(keys)
+			return nil, apiErr
+		}
+		keys = append(keys, key)
+
+		copied = append(copied, FileVariant{
+			Name:        v.Name,
+			Size:        size,
+			ETag:        etag,
+			ContentType: v.ContentType,
+			Width:       v.Width,
+			Height:      v.Height,
+		})
 	}
 
-	fileHeader := fileForm[0]
+	return copied, nil
+}
 
-	bucketID := ctx.Request.Header.Get("x-nhost-bucket-id")
-	if bucketID == "" {
-		bucketID = "default"
-	}
-	fileName := ctx.Request.Header.Get("x-nhost-file-name")
-	if fileName == "" {
-		fileName = fileHeader.Filename
-	}
-	fileID := ctx.Request.Header.Get("x-nhost-file-id")
-	if fileID == "" {
-		fileID = uuid.New().String()
-	}
+// adminHeaders builds the Hasura admin-secret header set used whenever the
+// controller talks to metadataStorage on its own behalf, outside the
+// requesting user's own headers.
+func (ctrl *Controller) adminHeaders() http.Header {
+	return http.Header{"x-hasura-admin-secret": []string{ctrl.hasuraAdminSecret}}
+}
 
-	ctx.Writer.Header().Add(
-		"X-deprecation-warning-old-upload-file-method",
-		"please, update the SDK to leverage new API endpoint or read the API docs to adapt your code",
+// populateFileMetadata finalizes a file's metadata row once its content is
+// already in place in contentStorage - whether that's because uploadOne just
+// streamed it there, a hash-dedup hit pointed it at an existing blob, or the
+// finalize step of the presigned-post flow confirmed it via HeadFile. This is
+// the one place that calls metadataStorage.PopulateMetadata so all three
+// paths stay consistent.
+func (ctrl *Controller) populateFileMetadata(
+	ctx context.Context,
+	file fileData,
+	bucket Bucket,
+	size int64,
+	etag, contentType, blurhash, contentHash, deleteKey string,
+) (FileMetadata, *APIError) {
+	metadata, apiErr := ctrl.metadataStorage.PopulateMetadata(
+		ctx,
+		file.ID, file.Name, size, bucket.ID, etag, true, contentType, blurhash, contentHash,
+		deleteKey,
+		ctrl.adminHeaders(),
 	)
+	if apiErr != nil {
+		return FileMetadata{}, apiErr.ExtendError(fmt.Sprintf("problem populating file metadata for file %s", file.Name))
+	}
 
-	return uploadFileRequest{
-		bucketID: bucketID,
-		files: []fileData{
-			{
-				Name:   fileName,
-				ID:     fileID,
-				header: fileHeader,
-			},
-		},
-		headers: ctx.Request.Header,
-	}, nil
+	return metadata, nil
 }
 
-func parseUploadRequestNew(ctx *gin.Context) (uploadFileRequest, *APIError) {
-	form, err := ctx.MultipartForm()
-	if err != nil {
-		return uploadFileRequest{}, InternalServerError(fmt.Errorf("problem reading multipart form: %w", err))
+func (ctrl *Controller) getBucket(ctx context.Context, bucketID string) (Bucket, *APIError) {
+	return ctrl.metadataStorage.GetBucketByID(ctx, bucketID, ctrl.adminHeaders())
+}
+
+// maxFormFieldSize bounds bucket-id/metadata[] part reads the same way
+// maxSizeReader bounds file[] parts, so an oversized non-file field can't
+// defeat uploadFile's streaming memory bound.
+const maxFormFieldSize = 8 * 1024
+
+func readFormPart(part *multipart.Part) (string, *APIError) {
+	buf := &bytes.Buffer{}
+	if _, err := io.CopyN(buf, part, maxFormFieldSize+1); err != nil && !errors.Is(err, io.EOF) {
+		return "", InternalServerError(fmt.Errorf("problem reading form field %s: %w", part.FormName(), err))
 	}
 
-	files, ok := form.File["file[]"]
-	if !ok {
-		return uploadFileRequest{}, ErrMultipartFormFileNotFound
+	if buf.Len() > maxFormFieldSize {
+		return "", WrongMetadataFormatError(fmt.Errorf("form field %s exceeds %d bytes", part.FormName(), maxFormFieldSize))
 	}
 
-	md, ok := form.Value["metadata[]"]
-	if ok {
-		if len(md) != len(files) {
-			return uploadFileRequest{}, ErrMetadataLength
-		}
+	return buf.String(), nil
+}
+
+// uploadFile walks ctx.Request.MultipartReader() part by part and pipes
+// each file part directly into contentStorage.PutFile as it is read,
+// instead of materializing the whole upload via ctx.MultipartForm() first
+// (which buffers every part to disk/memory before we even see it, and is
+// fatal for multi-gigabyte uploads).
+//
+// bucket-id and metadata[] fields are expected to precede the file[] part
+// they describe, matching the order the existing SDKs already send.
+func (ctrl *Controller) uploadFile(ctx *gin.Context) ([]FileMetadata, bool, *APIError) {
+	reader, err := ctx.Request.MultipartReader()
+	if err != nil {
+		return nil, false, InternalServerError(fmt.Errorf("problem reading multipart form: %w", err))
 	}
-	processedFiles := make([]fileData, len(files))
 
-	for idx, fileHeader := range files {
-		fileReq, err := fileDataFromFormValue(form.Value, fileHeader, idx)
-		if err != nil {
-			return uploadFileRequest{}, err
-		}
-		if fileReq.Name == "" {
-			fileReq.Name = fileHeader.Filename
+	var (
+		bucketID      = "default"
+		pendingData   = fileData{}
+		bucket        Bucket
+		haveBucket    = false
+		filesMetadata = []FileMetadata{}
+	)
+
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
 		}
-		if fileReq.ID == "" {
-			fileReq.ID = uuid.New().String()
+		if err != nil {
+			return filesMetadata, true, InternalServerError(fmt.Errorf("problem reading multipart form: %w", err))
 		}
-		processedFiles[idx] = fileReq
-	}
 
-	return uploadFileRequest{
-		bucketID: getBucketIDFromFormValue(form.Value),
-		files:    processedFiles,
-		headers:  ctx.Request.Header,
-	}, nil
-}
+		switch part.FormName() {
+		case "bucket-id":
+			value, apiErr := readFormPart(part)
+			if apiErr != nil {
+				return filesMetadata, true, apiErr
+			}
+			bucketID = value
+		case "metadata[]":
+			value, apiErr := readFormPart(part)
+			if apiErr != nil {
+				return filesMetadata, true, apiErr
+			}
+			data := fileData{}
+			if err := json.Unmarshal([]byte(value), &data); err != nil {
+				return filesMetadata, true, WrongMetadataFormatError(err)
+			}
+			pendingData = data
+		case "file[]", "file":
+			if !haveBucket {
+				if hdr := ctx.Request.Header.Get("x-nhost-bucket-id"); part.FormName() == "file" && hdr != "" {
+					bucketID = hdr
+				}
+				b, apiErr := ctrl.getBucket(ctx.Request.Context(), bucketID)
+				if apiErr != nil {
+					return filesMetadata, true, apiErr
+				}
+				bucket = b
+				haveBucket = true
+			}
+
+			data := pendingData
+			pendingData = fileData{}
+
+			if part.FormName() == "file" {
+				data.Name = ctx.Request.Header.Get("x-nhost-file-name")
+				data.ID = ctx.Request.Header.Get("x-nhost-file-id")
+			}
+			if data.Name == "" {
+				data.Name = part.FileName()
+			}
+			if data.ID == "" {
+				data.ID = uuid.New().String()
+			}
 
-func parseUploadRequest(ctx *gin.Context) (uploadFileRequest, bool, *APIError) {
-	newMethod := true
-	req, apiErr := parseUploadRequestNew(ctx)
-	if errors.Is(apiErr, ErrMultipartFormFileNotFound) {
-		req, apiErr = parseUploadRequestOld(ctx)
-		newMethod = false
+			metadata, apiErr := ctrl.uploadOne(ctx.Request.Context(), bucket, data, part, ctx.Request.Header)
+			if apiErr != nil {
+				return filesMetadata, true, apiErr
+			}
+
+			filesMetadata = append(filesMetadata, metadata)
+
+			if part.FormName() == "file" {
+				ctx.Writer.Header().Add(
+					"X-deprecation-warning-old-upload-file-method",
+					"please, update the SDK to leverage new API endpoint or read the API docs to adapt your code",
+				)
+				return filesMetadata, false, nil
+			}
+		}
 	}
-	return req, newMethod, apiErr
-}
 
-func (ctrl *Controller) uploadFile(ctx *gin.Context) ([]FileMetadata, bool, *APIError) {
-	request, newMethod, apiErr := parseUploadRequest(ctx)
-	if apiErr != nil {
-		return nil, false, apiErr
+	if !haveBucket {
+		return filesMetadata, true, ErrMultipartFormFileNotFound
 	}
 
-	filesMetadata, apiErr := ctrl.upload(ctx.Request.Context(), request)
-	return filesMetadata, newMethod, apiErr
+	return filesMetadata, true, nil
 }
 
 func (ctrl *Controller) UploadFile(ctx *gin.Context) {
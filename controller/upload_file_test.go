@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpiresAt(t *testing.T) {
+	t.Parallel()
+
+	if got, apiErr := parseExpiresAt(""); apiErr != nil || !got.IsZero() {
+		t.Errorf("parseExpiresAt(\"\") = %v, %v, want zero time, nil", got, apiErr)
+	}
+
+	before := time.Now()
+	got, apiErr := parseExpiresAt("60")
+	if apiErr != nil {
+		t.Fatalf("parseExpiresAt(\"60\") returned %v", apiErr)
+	}
+	if got.Before(before.Add(59*time.Second)) || got.After(before.Add(61*time.Second)) {
+		t.Errorf("parseExpiresAt(\"60\") = %v, want ~60s from now", got)
+	}
+
+	want := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	got, apiErr = parseExpiresAt(want.Format(time.RFC3339))
+	if apiErr != nil || !got.Equal(want) {
+		t.Errorf("parseExpiresAt(RFC3339) = %v, %v, want %v, nil", got, apiErr, want)
+	}
+
+	if _, apiErr := parseExpiresAt("not-a-time"); apiErr == nil {
+		t.Error("parseExpiresAt(\"not-a-time\") returned nil error, want WrongMetadataFormatError")
+	}
+}
+
+func TestMaxSizeReaderSurfacesFileTooBigError(t *testing.T) {
+	t.Parallel()
+
+	limited := &maxSizeReader{r: strings.NewReader("0123456789"), name: "f.bin", maxSize: 4}
+
+	_, err := io.Copy(io.Discard, limited)
+
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("io.Copy error = %v, want an *APIError", err)
+	}
+}
+
+func TestMaxSizeReaderAllowsExactLimit(t *testing.T) {
+	t.Parallel()
+
+	limited := &maxSizeReader{r: strings.NewReader("0123456789"), name: "f.bin", maxSize: 10}
+
+	if _, err := io.Copy(io.Discard, limited); err != nil {
+		t.Errorf("io.Copy returned %v, want nil for a read at exactly maxSize", err)
+	}
+}
+
+func TestReadErrRecoversAPIError(t *testing.T) {
+	t.Parallel()
+
+	want := FileTooBigError("f.bin", 10, 4)
+	if got := readErr(want, "problem reading file f.bin"); got != want {
+		t.Errorf("readErr returned %v, want the original %v", got, want)
+	}
+
+	if got := readErr(errors.New("boom"), "problem reading file f.bin"); got == nil {
+		t.Error("readErr returned nil for a non-APIError, want InternalServerError")
+	}
+}
+
+func TestSniffPartContentTypePreservesBytes(t *testing.T) {
+	t.Parallel()
+
+	content := []byte("just a plain text file, nothing fancy here")
+
+	reader, contentType, apiErr := sniffPartContentType(bytes.NewReader(content))
+	if apiErr != nil {
+		t.Fatalf("sniffPartContentType returned %v", apiErr)
+	}
+	if contentType != "text/plain; charset=utf-8" {
+		t.Errorf("contentType = %q, want text/plain", contentType)
+	}
+
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading sniffed reader: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("sniffed reader replayed %q, want %q", got, content)
+	}
+}
+
+func multipartPart(t *testing.T, fieldName, value string) *multipart.Part {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if err := writer.WriteField(fieldName, value); err != nil {
+		t.Fatalf("writing field: %v", err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("closing writer: %v", err)
+	}
+
+	reader := multipart.NewReader(body, writer.Boundary())
+	part, err := reader.NextPart()
+	if err != nil {
+		t.Fatalf("reading part: %v", err)
+	}
+
+	return part
+}
+
+func TestReadFormPartUnderLimit(t *testing.T) {
+	t.Parallel()
+
+	part := multipartPart(t, "bucket-id", "default")
+
+	got, apiErr := readFormPart(part)
+	if apiErr != nil {
+		t.Fatalf("readFormPart returned %v", apiErr)
+	}
+	if got != "default" {
+		t.Errorf("readFormPart returned %q, want %q", got, "default")
+	}
+}
+
+func TestReadFormPartOverLimit(t *testing.T) {
+	t.Parallel()
+
+	part := multipartPart(t, "metadata[]", strings.Repeat("x", maxFormFieldSize+1))
+
+	if _, apiErr := readFormPart(part); apiErr == nil {
+		t.Error("readFormPart returned nil error for an oversized field, want WrongMetadataFormatError")
+	}
+}
+
+func TestVariantKeys(t *testing.T) {
+	t.Parallel()
+
+	variants := []FileVariant{
+		{Name: "thumb_200x200"},
+		{Name: "thumb_800x0"},
+	}
+
+	got := variantKeys("file-id", variants)
+	want := []string{"file-id/thumb_200x200.webp", "file-id/thumb_800x0.webp"}
+
+	if len(got) != len(want) {
+		t.Fatalf("variantKeys returned %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("variantKeys()[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}